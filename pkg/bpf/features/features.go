@@ -0,0 +1,217 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package features centralizes the kernel/BPF capability probing the CPU
+// profiler needs at startup, so the rest of the codebase can ask "can I use
+// X" instead of sprinkling kernel-version heuristics across the loader.
+package features
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+	cilium_features "github.com/cilium/ebpf/features"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mapTypes are the BPF_MAP_TYPE_* values the agent may rely on, depending on
+// which unwinders and buffering strategy it ends up using.
+var mapTypes = []ebpf.MapType{
+	ebpf.Hash,
+	ebpf.PerCPUHash,
+	ebpf.StackTrace,
+	ebpf.RingBuf,
+	ebpf.PerfEventArray,
+	ebpf.TaskStorage,
+}
+
+// progTypes are the BPF_PROG_TYPE_* values the agent may load, depending on
+// which unwinders are enabled.
+var progTypes = []ebpf.ProgramType{
+	ebpf.PerfEvent,
+	ebpf.Tracing,
+	ebpf.Kprobe,
+}
+
+// Registry holds the result of probing the running kernel once at startup,
+// so the rest of the agent can make cheap, synchronous capability checks
+// instead of re-probing (and potentially loading throwaway BPF programs) on
+// every call.
+type Registry struct {
+	logger log.Logger
+
+	mu         sync.RWMutex
+	mapTypes   map[ebpf.MapType]bool
+	progTypes  map[ebpf.ProgramType]bool
+	batchOps   bool
+	ringBuffer bool
+	btf        bool
+	coreRelocs bool
+}
+
+// NewRegistry probes the running kernel for every capability the agent may
+// need and caches the results. It never returns an error: a probe that
+// fails to run is recorded as unsupported, since the safest default is to
+// fall back to the more compatible code path.
+func NewRegistry(logger log.Logger) *Registry {
+	r := &Registry{
+		logger:    logger,
+		mapTypes:  make(map[ebpf.MapType]bool, len(mapTypes)),
+		progTypes: make(map[ebpf.ProgramType]bool, len(progTypes)),
+	}
+
+	for _, mt := range mapTypes {
+		r.mapTypes[mt] = cilium_features.HaveMapType(mt) == nil
+	}
+	for _, pt := range progTypes {
+		r.progTypes[pt] = cilium_features.HaveProgramType(pt) == nil
+	}
+
+	r.batchOps = r.probeBatchOperations()
+	r.ringBuffer = r.mapTypes[ebpf.RingBuf]
+	r.btf = probeBTF()
+	r.coreRelocs = r.btf
+
+	r.log()
+
+	return r
+}
+
+// probeBatchOperations attempts a zero-sized batch lookup-and-delete against
+// a throwaway map, since there is no dedicated feature probe for the batch
+// map ops in upstream cilium/ebpf.
+func (r *Registry) probeBatchOperations() bool {
+	m, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1,
+	})
+	if err != nil {
+		return false
+	}
+	defer m.Close()
+
+	cursor := new(ebpf.MapBatchCursor)
+	keys := make([]uint32, 1)
+	values := make([]uint64, 1)
+	_, err = m.BatchLookupAndDelete(cursor, keys, values, nil)
+
+	return err == nil || err == ebpf.ErrKeyNotExist
+}
+
+// probeBTF reports whether the running kernel exposes its own BTF, which
+// CO-RE relocations and BTF-defined maps depend on. It loads the kernel's
+// BTF the same way the CO-RE loader does (see loadKernelBTFSpec in
+// pkg/profiler/cpu/core.go), rather than aliasing an unrelated verifier
+// feature, since neither HaveLargeInstructions nor any other program-load
+// probe actually exercises BTF.
+func probeBTF() bool {
+	_, err := btf.LoadKernelSpec()
+	return err == nil
+}
+
+func (r *Registry) log() {
+	level.Info(r.logger).Log(
+		"msg", "probed kernel BPF capabilities",
+		"ringbuf", r.ringBuffer,
+		"batch_ops", r.batchOps,
+		"btf", r.btf,
+		"core_relocations", r.coreRelocs,
+	)
+}
+
+// HasMapType reports whether the kernel supports loading the given map type.
+func (r *Registry) HasMapType(mt ebpf.MapType) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mapTypes[mt]
+}
+
+// HasProgramType reports whether the kernel supports loading the given
+// program type.
+func (r *Registry) HasProgramType(pt ebpf.ProgramType) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.progTypes[pt]
+}
+
+// HasBatchOperations reports whether BPF_MAP_LOOKUP_AND_DELETE_BATCH is
+// supported on this kernel.
+func (r *Registry) HasBatchOperations() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.batchOps
+}
+
+// HasRingBuffer reports whether BPF_MAP_TYPE_RINGBUF is supported, so the
+// profiler can fall back to a perf buffer otherwise.
+func (r *Registry) HasRingBuffer() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ringBuffer
+}
+
+// HasBTF reports whether the kernel exposes BTF, which CO-RE relocations and
+// some interpreter unwinders depend on.
+func (r *Registry) HasBTF() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.btf
+}
+
+// Describe implements prometheus.Collector.
+func (r *Registry) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(r, ch)
+}
+
+// Collect implements prometheus.Collector, exposing every probed capability
+// as a gauge so operators can see what the agent fell back to without
+// reading its logs.
+func (r *Registry) Collect(ch chan<- prometheus.Metric) {
+	desc := prometheus.NewDesc(
+		"parca_agent_bpf_feature_supported",
+		"Whether a given BPF kernel feature is supported (1) or not (0).",
+		[]string{"feature"}, nil,
+	)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	emit := func(name string, supported bool) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, boolToFloat(supported), name)
+	}
+
+	for mt, ok := range r.mapTypes {
+		emit(fmt.Sprintf("map_type_%s", mt), ok)
+	}
+	for pt, ok := range r.progTypes {
+		emit(fmt.Sprintf("prog_type_%s", pt), ok)
+	}
+	emit("batch_operations", r.batchOps)
+	emit("ring_buffer", r.ringBuffer)
+	emit("btf", r.btf)
+	emit("core_relocations", r.coreRelocs)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
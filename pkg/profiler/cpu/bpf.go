@@ -0,0 +1,156 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/parca-dev/parca-agent/pkg/bpf/features"
+)
+
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -g -Wall -target bpf" -target amd64,arm64 bpf ./bpf/cpu.bpf.c -- -I./bpf/include
+
+// Config controls how the CPU profiler's BPF program is loaded and how the
+// unwinders it ships with behave at runtime. BPFVerboseLoggingEnabled is the
+// only knob still driven by caller preference; every other capability is
+// auto-negotiated against Features at load time.
+type Config struct {
+	DWARFUnwindingDisabled         bool
+	DWARFUnwindingMixedModeEnabled bool
+	BPFVerboseLoggingEnabled       bool
+	BPFEventsBufferSize            uint32
+	PythonUnwindingEnabled         bool
+	RubyUnwindingEnabled           bool
+	RateLimitUnwindInfo            int64
+	RateLimitProcessMappings       int64
+	RateLimitRefreshProcessInfo    int64
+
+	// Features is the result of probing the running kernel's BPF
+	// capabilities. If nil, loadBPFModules probes it itself.
+	Features *features.Registry
+}
+
+// stackCountKey mirrors the layout of struct stack_count_key in cpu.bpf.c and
+// is used as the typed key for each process's inner stack-counts map.
+type stackCountKey struct {
+	PID           uint32
+	UserStackID   int64
+	KernelStackID int64
+}
+
+// stackCountsTemplate mirrors stack_counts_template in cpu.bpf.c: the
+// per-process inner map that EnsureProcess creates on demand, sized to that
+// process's expected cardinality, and installs into the stack_counts outer
+// map. It is declared here rather than read off the outer map's BTF because
+// it is resized per process anyway (see ProcessStackCounts.EnsureProcess).
+var stackCountsTemplate = &ebpf.MapSpec{
+	Name:       "stack_counts_template",
+	Type:       ebpf.Hash,
+	KeySize:    uint32(unsafe.Sizeof(stackCountKey{})),
+	ValueSize:  8,
+	MaxEntries: 1,
+}
+
+// Module bundles the loaded BPF maps/programs with ProcessStackCounts, the
+// manager for the per-process inner maps installed into the stack_counts
+// map-of-maps.
+type Module struct {
+	*bpfObjects
+	ProcessStackCounts *ProcessStackCounts
+}
+
+// loadBPFModules loads the embedded BPF bytecode for the CPU profiler into
+// the kernel using cilium/ebpf and returns the typed maps and programs it
+// contains. The agent binary ships the compiled ELF, embedded by
+// bpf_bpfel.go/bpf_bpfeb.go, so there is no runtime dependency on libbpf or
+// libelf.
+func loadBPFModules(logger log.Logger, reg prometheus.Registerer, memLock uint64, cfg Config) (*Module, error) {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		level.Warn(logger).Log("msg", "failed to remove memlock rlimit", "err", err)
+	}
+
+	feats := cfg.Features
+	if feats == nil {
+		feats = features.NewRegistry(logger)
+	}
+	if reg != nil {
+		reg.MustRegister(feats)
+	}
+
+	if !feats.HasProgramType(ebpf.PerfEvent) {
+		return nil, fmt.Errorf("kernel does not support BPF_PROG_TYPE_PERF_EVENT, which the CPU profiler requires")
+	}
+	if (cfg.PythonUnwindingEnabled || cfg.RubyUnwindingEnabled) && !feats.HasProgramType(ebpf.Tracing) {
+		level.Warn(logger).Log("msg", "kernel does not support fentry/tracing programs, disabling interpreter unwinders")
+		cfg.PythonUnwindingEnabled = false
+		cfg.RubyUnwindingEnabled = false
+	}
+
+	spec, err := loadBpf()
+	if err != nil {
+		return nil, fmt.Errorf("load collection spec: %w", err)
+	}
+
+	if cfg.BPFEventsBufferSize > 0 {
+		m := spec.Maps["events"]
+		if feats.HasRingBuffer() {
+			m.MaxEntries = cfg.BPFEventsBufferSize
+		} else {
+			level.Info(logger).Log("msg", "kernel does not support BPF_MAP_TYPE_RINGBUF, falling back to perf buffers")
+			m.Type = ebpf.PerfEventArray
+			m.KeySize = 4
+			m.ValueSize = 4
+		}
+	}
+
+	opts := &ebpf.CollectionOptions{
+		Programs: ebpf.ProgramOptions{
+			LogDisabled: !cfg.BPFVerboseLoggingEnabled,
+		},
+	}
+
+	// loadKernelBTFSpec tries the running kernel's own BTF first and falls
+	// back to BTFHub itself; gating this call on feats.HasBTF() would make
+	// that fallback unreachable; since it's the one case it exists for.
+	btfSpec, err := loadKernelBTFSpec(logger)
+	if err != nil {
+		return nil, fmt.Errorf("load BTF spec: %w", err)
+	}
+	if coreSpec, ok := applyCOREOptions(logger, btfSpec); ok {
+		opts.Programs.KernelTypes = coreSpec
+	}
+
+	spec.Maps["stack_counts"].InnerMap = stackCountsTemplate
+
+	var objs bpfObjects
+	if err := spec.LoadAndAssign(&objs, opts); err != nil {
+		return nil, fmt.Errorf("load and assign BPF objects: %w", err)
+	}
+
+	batchOps := feats.HasBatchOperations()
+	level.Debug(logger).Log("msg", "loaded BPF program", "mem_lock", memLock, "batch_ops", batchOps)
+
+	return &Module{
+		bpfObjects:         &objs,
+		ProcessStackCounts: newProcessStackCounts(objs.StackCounts, stackCountsTemplate, batchOps),
+	}, nil
+}
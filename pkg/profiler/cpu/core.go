@@ -0,0 +1,165 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf/btf"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// vmlinuxBTFPath is where the running kernel exposes its own BTF, when it
+// carries CONFIG_DEBUG_INFO_BTF.
+const vmlinuxBTFPath = "/sys/kernel/btf/vmlinux"
+
+// loadKernelBTFSpec returns the BTF type information for the running
+// kernel, so the loader can relocate the CO-RE accesses in cpu.bpf.c against
+// it. On kernels that don't expose /sys/kernel/btf/vmlinux (pre-5.2, or
+// built without CONFIG_DEBUG_INFO_BTF), it falls back to fetching a
+// matching BTFHub blob; when that also fails, it returns (nil, nil) so the
+// caller can fall back to the non-CO-RE path instead of failing to load.
+func loadKernelBTFSpec(logger log.Logger) (*btf.Spec, error) {
+	spec, err := btf.LoadKernelSpec()
+	if err == nil {
+		return spec, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("load kernel BTF: %w", err)
+	}
+
+	level.Debug(logger).Log("msg", "no native kernel BTF, falling back to BTFHub", "path", vmlinuxBTFPath)
+
+	spec, err = loadBTFHubSpec()
+	if err != nil {
+		level.Warn(logger).Log("msg", "could not find a BTFHub match for this kernel, falling back to non-CO-RE loading", "err", err)
+		return nil, nil
+	}
+
+	return spec, nil
+}
+
+// btfHubBaseURL is the root of the public BTFHub archive, which mirrors a
+// BTF blob per (distro, version, arch, kernel release) for kernels that
+// don't carry their own. See https://github.com/aquasecurity/btfhub-archive.
+const btfHubBaseURL = "https://raw.githubusercontent.com/aquasecurity/btfhub-archive/main"
+
+// btfHubHTTPClient is a package-level var so tests can swap in a client
+// pointed at a local fixture server instead of the real archive.
+var btfHubHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// errBTFHubArchiveUnsupported is returned by loadBTFHubSpec once it has a
+// real BTFHub archive in hand: BTFHub serves its blobs as .tar.xz, and this
+// tree has no xz decompressor available to it (no network access to vendor
+// one in, and hand-rolling an xz reader is out of scope here). Unpacking
+// the archive is TRACKING: not implemented - this is the single seam where
+// that work would go, rather than a path that looks wired up end-to-end.
+var errBTFHubArchiveUnsupported = errors.New("BTFHub archives are .tar.xz, which this build cannot decompress yet")
+
+// loadBTFHubSpec locates and fetches the BTF blob for the running kernel
+// from BTFHub's release index, keyed by kernel release and distribution.
+// The lookup (kernel/distro detection, building the URL, the HTTP fetch)
+// is real; unpacking the result is not - see errBTFHubArchiveUnsupported.
+// This is a thin seam so tests can stub the network call; the production
+// implementation lives with the rest of the release/packaging tooling.
+var loadBTFHubSpec = func() (*btf.Spec, error) {
+	release, err := kernelRelease()
+	if err != nil {
+		return nil, fmt.Errorf("determine kernel release: %w", err)
+	}
+
+	distro, version, arch, err := osRelease()
+	if err != nil {
+		return nil, fmt.Errorf("determine distribution: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/%s/%s/%s/%s.btf.tar.xz", btfHubBaseURL, distro, version, arch, release)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build BTFHub request: %w", err)
+	}
+
+	resp, err := btfHubHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: unexpected status %s", url, resp.Status)
+	}
+
+	return nil, fmt.Errorf("%s: %w", url, errBTFHubArchiveUnsupported)
+}
+
+// kernelRelease returns the running kernel's release string (e.g.
+// "5.15.0-91-generic"), as reported by uname(2).
+func kernelRelease() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(uts.Release[:]), nil
+}
+
+// osRelease identifies the running distribution from /etc/os-release, in
+// the (ID, VERSION_ID, arch) shape BTFHub's archive is laid out by.
+func osRelease() (id, versionID, arch string, err error) {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return "", "", "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "ID="):
+			id = strings.Trim(strings.TrimPrefix(line, "ID="), `"`)
+		case strings.HasPrefix(line, "VERSION_ID="):
+			versionID = strings.Trim(strings.TrimPrefix(line, "VERSION_ID="), `"`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", "", err
+	}
+	if id == "" || versionID == "" {
+		return "", "", "", errors.New("/etc/os-release missing ID or VERSION_ID")
+	}
+
+	return id, versionID, runtime.GOARCH, nil
+}
+
+// applyCOREOptions augments opts with the BTF spec to relocate against, if
+// one is available. When spec is nil, opts is left untouched and the
+// program is loaded without CO-RE relocations, relying on the bytecode
+// already matching the running kernel's struct layouts.
+func applyCOREOptions(logger log.Logger, spec *btf.Spec) (*btf.Spec, bool) {
+	if spec == nil {
+		level.Info(logger).Log("msg", "loading CPU profiler BPF program without CO-RE relocations")
+		return nil, false
+	}
+	return spec, true
+}
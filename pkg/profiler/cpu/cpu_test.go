@@ -15,55 +15,36 @@
 package cpu
 
 import (
-	"syscall"
 	"testing"
-	"unsafe"
 
-	"github.com/Masterminds/semver/v3"
-	bpf "github.com/aquasecurity/libbpfgo"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 
-	"github.com/parca-dev/parca-agent/pkg/kernel"
+	"github.com/parca-dev/parca-agent/pkg/bpf/features"
 	"github.com/parca-dev/parca-agent/pkg/logger"
-	bpfmaps "github.com/parca-dev/parca-agent/pkg/profiler/cpu/bpf/maps"
 )
 
-// bpfVerboseLoggingEnabled returns false if the verbose BPF logs should be disabled
-// for the kernel versions.
-func bpfVerboseLoggingEnabled() bool {
-	kernelRelease, err := kernel.GetRelease()
-	if err != nil {
-		panic("bad kernel release")
-	}
-	constrain, err := semver.NewConstraint(">5.10")
-	if err != nil {
-		panic("bad constrain, this should never happen")
-	}
-
-	return constrain.Check(kernelRelease)
-}
-
-// The intent of these tests is to ensure that libbpfgo behaves the
-// way we expect.
+// The intent of these tests is to ensure that our cilium/ebpf based loader
+// behaves the way we expect.
 //
 // We also use them to ensure that different kernel versions load our
 // BPF program.
-func SetUpBpfProgram(t *testing.T) (*bpf.Module, error) {
+func SetUpBpfProgram(t *testing.T) (*Module, error) {
 	t.Helper()
 	logger := logger.NewLogger("debug", logger.LogFormatLogfmt, "parca-cpu-test")
 
 	memLock := uint64(1200 * 1024 * 1024) // ~1.2GiB
-	m, _, err := loadBPFModules(logger, prometheus.NewRegistry(), memLock, Config{
+	m, err := loadBPFModules(logger, prometheus.NewRegistry(), memLock, Config{
 		DWARFUnwindingMixedModeEnabled: true,
 		DWARFUnwindingDisabled:         false,
-		BPFVerboseLoggingEnabled:       bpfVerboseLoggingEnabled(),
+		BPFVerboseLoggingEnabled:       true,
 		BPFEventsBufferSize:            8192,
 		PythonUnwindingEnabled:         false,
 		RubyUnwindingEnabled:           false,
 		RateLimitUnwindInfo:            50,
 		RateLimitProcessMappings:       50,
 		RateLimitRefreshProcessInfo:    50,
+		Features:                       features.NewRegistry(logger),
 	})
 	require.NoError(t, err)
 	require.NotNil(t, m)
@@ -71,130 +52,116 @@ func SetUpBpfProgram(t *testing.T) (*bpf.Module, error) {
 	return m, err
 }
 
-func TestDeleteNonExistentKeyReturnsEnoent(t *testing.T) {
-	m, err := SetUpBpfProgram(t)
-	require.NoError(t, err)
-	t.Cleanup(m.Close)
-	bpfMap, err := m.GetMap(bpfmaps.StackCountsMapName)
-	require.NoError(t, err)
-
-	stackID := int32(1234)
-
-	// Delete should fail as the key doesn't exist.
-	err = bpfMap.DeleteKey(unsafe.Pointer(&stackID))
-	require.Error(t, err)
-	require.ErrorIs(t, err, syscall.ENOENT)
+func hasBatchOperations(t *testing.T) bool {
+	t.Helper()
+	logger := logger.NewLogger("debug", logger.LogFormatLogfmt, "parca-cpu-test")
+	return features.NewRegistry(logger).HasBatchOperations()
 }
 
-func TestDeleteExistentKey(t *testing.T) {
+func TestEnsureProcessThenDeleteRemovesOuterEntry(t *testing.T) {
 	m, err := SetUpBpfProgram(t)
 	require.NoError(t, err)
-	t.Cleanup(m.Close)
-	bpfMap, err := m.GetMap(bpfmaps.StackCountsMapName)
-	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
 
-	stackID := int32(1234)
+	const pid = uint32(1234)
 
-	// Insert some element that will be later deleted.
-	value := []byte{'a'}
-	err = bpfMap.Update(unsafe.Pointer(&stackID), unsafe.Pointer(&value[0]))
+	_, err = m.ProcessStackCounts.EnsureProcess(pid, 128)
 	require.NoError(t, err)
 
-	// Delete should work.
-	err = bpfMap.DeleteKey(unsafe.Pointer(&stackID))
+	pids, err := m.ProcessStackCounts.Processes()
 	require.NoError(t, err)
-}
+	require.Contains(t, pids, pid)
 
-func hasBatchOperations(t *testing.T) bool {
-	t.Helper()
+	require.NoError(t, m.ProcessStackCounts.DeleteProcess(pid))
 
-	m, err := SetUpBpfProgram(t)
-	require.NoError(t, err)
-	t.Cleanup(m.Close)
-	bpfMap, err := m.GetMap(bpfmaps.StackCountsMapName)
+	pids, err = m.ProcessStackCounts.Processes()
 	require.NoError(t, err)
+	require.NotContains(t, pids, pid)
+}
 
-	keys := make([]stackCountKey, bpfMap.MaxEntries())
-	countKeysPtr := unsafe.Pointer(&keys[0])
-	nextCountKey := uintptr(1)
-	batchSize := bpfMap.MaxEntries()
-	_, err = bpfMap.GetValueAndDeleteBatch(countKeysPtr, nil, unsafe.Pointer(&nextCountKey), batchSize)
+// TestDrainMissingProcessReturnsNil covers the case where a process exited
+// (and the kernel dropped its inner map) between user space deciding to
+// drain it and the actual drain - it must not be treated as an error.
+func TestDrainMissingProcessReturnsNil(t *testing.T) {
+	m, err := SetUpBpfProgram(t)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
 
-	return err == nil
+	counts, err := m.ProcessStackCounts.Drain(999999)
+	require.NoError(t, err)
+	require.Nil(t, counts)
 }
 
-func TestGetValueAndDeleteBatchWithEmptyMap(t *testing.T) {
+func TestDrainEmptyProcessMap(t *testing.T) {
 	if !hasBatchOperations(t) {
 		t.Skip("Skipping testing of batched operations as they aren't supported")
 	}
 
 	m, err := SetUpBpfProgram(t)
 	require.NoError(t, err)
-	t.Cleanup(m.Close)
-	bpfMap, err := m.GetMap(bpfmaps.StackCountsMapName)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
+
+	const pid = uint32(1234)
+	_, err = m.ProcessStackCounts.EnsureProcess(pid, 16)
 	require.NoError(t, err)
 
-	keys := make([]stackCountKey, bpfMap.MaxEntries())
-	countKeysPtr := unsafe.Pointer(&keys[0])
-	nextCountKey := uintptr(1)
-	batchSize := bpfMap.MaxEntries()
-	values, err := bpfMap.GetValueAndDeleteBatch(countKeysPtr, nil, unsafe.Pointer(&nextCountKey), batchSize)
+	counts, err := m.ProcessStackCounts.Drain(pid)
 	require.NoError(t, err)
-	require.Empty(t, values)
+	require.Empty(t, counts)
 }
 
-func TestGetValueAndDeleteBatchFewerElementsThanCount(t *testing.T) {
+func TestDrainReturnsSamplesForExactProcess(t *testing.T) {
 	if !hasBatchOperations(t) {
 		t.Skip("Skipping testing of batched operations as they aren't supported")
 	}
 
 	m, err := SetUpBpfProgram(t)
 	require.NoError(t, err)
-	t.Cleanup(m.Close)
-	bpfMap, err := m.GetMap(bpfmaps.StackCountsMapName)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
+
+	const pidA, pidB = uint32(1234), uint32(5678)
+	innerA, err := m.ProcessStackCounts.EnsureProcess(pidA, 16)
+	require.NoError(t, err)
+	innerB, err := m.ProcessStackCounts.EnsureProcess(pidB, 16)
 	require.NoError(t, err)
 
-	stackID := int32(1234)
+	keyA := stackCountKey{PID: pidA, UserStackID: 1}
+	keyB := stackCountKey{PID: pidB, UserStackID: 1}
+	require.NoError(t, innerA.Put(keyA, uint64(3)))
+	require.NoError(t, innerB.Put(keyB, uint64(7)))
 
-	// Insert some element that will be later deleted.
-	value := []byte{'a'}
-	err = bpfMap.Update(unsafe.Pointer(&stackID), unsafe.Pointer(&value[0]))
+	// Draining only the active pid (pidA) must not disturb pidB's samples:
+	// this is the whole point of keying stack counts by process.
+	drained, err := m.ProcessStackCounts.DrainActive([]uint32{pidA})
 	require.NoError(t, err)
+	require.Equal(t, map[stackCountKey]uint64{keyA: 3}, drained[pidA])
 
-	// Request more elements than we have, this should return and delete everything.
-	keys := make([]stackCountKey, bpfMap.MaxEntries())
-	countKeysPtr := unsafe.Pointer(&keys[0])
-	nextCountKey := uintptr(1)
-	batchSize := bpfMap.MaxEntries()
-	values, err := bpfMap.GetValueAndDeleteBatch(countKeysPtr, nil, unsafe.Pointer(&nextCountKey), batchSize)
+	stillB, err := m.ProcessStackCounts.Drain(pidB)
 	require.NoError(t, err)
-	require.Len(t, values, 1)
+	require.Equal(t, map[stackCountKey]uint64{keyB: 7}, stillB)
 }
 
-func TestGetValueAndDeleteBatchExactElements(t *testing.T) {
-	if !hasBatchOperations(t) {
-		t.Skip("Skipping testing of batched operations as they aren't supported")
-	}
-
+func TestOuterMapIterationListsAllTrackedProcesses(t *testing.T) {
 	m, err := SetUpBpfProgram(t)
 	require.NoError(t, err)
-	t.Cleanup(m.Close)
-	bpfMap, err := m.GetMap(bpfmaps.StackCountsMapName)
-	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
 
-	stackID := int32(1234)
+	want := []uint32{111, 222, 333}
+	for _, pid := range want {
+		_, err := m.ProcessStackCounts.EnsureProcess(pid, 16)
+		require.NoError(t, err)
+	}
 
-	// Insert some element that will be later deleted.
-	value := []byte{'a'}
-	err = bpfMap.Update(unsafe.Pointer(&stackID), unsafe.Pointer(&value[0]))
+	got, err := m.ProcessStackCounts.Processes()
+	require.NoError(t, err)
+	require.ElementsMatch(t, want, got)
+}
+
+func TestDeleteNonExistentProcessIsNotAnError(t *testing.T) {
+	m, err := SetUpBpfProgram(t)
 	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
 
-	// Request exactly the elements we have.
-	keys := make([]stackCountKey, 1)
-	countKeysPtr := unsafe.Pointer(&keys[0])
-	nextCountKey := uintptr(1)
-	batchSize := uint32(1)
-	values, err := bpfMap.GetValueAndDeleteBatch(countKeysPtr, nil, unsafe.Pointer(&nextCountKey), batchSize)
+	err = m.ProcessStackCounts.DeleteProcess(404)
 	require.NoError(t, err)
-	require.Len(t, values, 1)
 }
@@ -0,0 +1,210 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/cilium/ebpf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProgramInfo describes one loaded BPF program, mirroring the fields
+// `bpftool prog show` reports off bpf_object__next_program.
+type ProgramInfo struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	RunCount  uint64 `json:"run_count"`
+	RunTimeNs uint64 `json:"run_time_ns"`
+}
+
+// MapInfo describes one loaded BPF map, mirroring the fields `bpftool map
+// show` reports off bpf_object__next_map.
+type MapInfo struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	KeySize      uint32 `json:"key_size"`
+	ValueSize    uint32 `json:"value_size"`
+	MaxEntries   uint32 `json:"max_entries"`
+	Entries      int    `json:"entries"`
+	MemlockBytes uint64 `json:"memlock_bytes"`
+}
+
+// Introspection is a point-in-time snapshot of every program and map the
+// CPU profiler has loaded.
+type Introspection struct {
+	Programs []ProgramInfo `json:"programs"`
+	Maps     []MapInfo     `json:"maps"`
+}
+
+// Introspect walks m's typed program and map fields by reflection (cilium/ebpf's
+// equivalent of iterating bpf_object__next_program/bpf_object__next_map) and
+// returns their current runtime stats. For stack_counts, a map-of-maps, the
+// reported entry count is the number of processes currently tracked, not
+// the number of buffered samples - use ProcessStackCounts to drain those.
+func (mod *Module) Introspect() (Introspection, error) {
+	var insp Introspection
+
+	progs := reflect.ValueOf(mod.bpfObjects.bpfPrograms)
+	for i := 0; i < progs.NumField(); i++ {
+		prog, ok := progs.Field(i).Interface().(*ebpf.Program)
+		if !ok || prog == nil {
+			continue
+		}
+		pi, err := programInfo(progs.Type().Field(i).Name, prog)
+		if err != nil {
+			return Introspection{}, err
+		}
+		insp.Programs = append(insp.Programs, pi)
+	}
+
+	maps := reflect.ValueOf(mod.bpfObjects.bpfMaps)
+	for i := 0; i < maps.NumField(); i++ {
+		bm, ok := maps.Field(i).Interface().(*ebpf.Map)
+		if !ok || bm == nil {
+			continue
+		}
+		mi, err := mapInfo(maps.Type().Field(i).Name, bm)
+		if err != nil {
+			return Introspection{}, err
+		}
+		insp.Maps = append(insp.Maps, mi)
+	}
+
+	return insp, nil
+}
+
+func programInfo(name string, prog *ebpf.Program) (ProgramInfo, error) {
+	info, err := prog.Info()
+	if err != nil {
+		return ProgramInfo{}, fmt.Errorf("program info for %s: %w", name, err)
+	}
+
+	pi := ProgramInfo{Name: name, Type: info.Type.String()}
+	if runtime, ok := info.Runtime(); ok {
+		pi.RunTimeNs = uint64(runtime.Nanoseconds())
+	}
+	if runCount, ok := info.RunCount(); ok {
+		pi.RunCount = runCount
+	}
+
+	return pi, nil
+}
+
+func mapInfo(name string, m *ebpf.Map) (MapInfo, error) {
+	mi := MapInfo{
+		Name:       name,
+		Type:       m.Type().String(),
+		KeySize:    m.KeySize(),
+		ValueSize:  m.ValueSize(),
+		MaxEntries: m.MaxEntries(),
+	}
+
+	count := 0
+	it := m.Iterate()
+	key := make([]byte, m.KeySize())
+	value := make([]byte, m.ValueSize())
+	for it.Next(&key, &value) {
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return MapInfo{}, fmt.Errorf("iterate map %s: %w", name, err)
+	}
+	mi.Entries = count
+
+	// cilium/ebpf doesn't surface the kernel's actual memlock accounting for
+	// a map, so approximate it the same way bpftool does when that field is
+	// unavailable: (key + value) size times the entry capacity.
+	mi.MemlockBytes = uint64(mi.KeySize+mi.ValueSize) * uint64(mi.MaxEntries)
+
+	return mi, nil
+}
+
+// DebugHandler serves the /debug/bpf introspection endpoint for a loaded
+// CPU profiler BPF module.
+type DebugHandler struct {
+	objs *Module
+}
+
+// NewDebugHandler returns an http.Handler that reports the programs and
+// maps in objs, the same module SetUpBpfProgram/loadBPFModules returns, so
+// operators can see what is loaded without attaching bpftool.
+func NewDebugHandler(objs *Module) *DebugHandler {
+	return &DebugHandler{objs: objs}
+}
+
+func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	insp, err := h.objs.Introspect()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(insp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// introspectionCollector exports the same data ServeHTTP returns as
+// Prometheus metrics, so operators can alert on a stack-counts map filling
+// up or an unwinder program getting disproportionately expensive.
+type introspectionCollector struct {
+	objs *Module
+
+	runTimeDesc *prometheus.Desc
+	mapEntries  *prometheus.Desc
+}
+
+// NewIntrospectionCollector returns a prometheus.Collector reporting
+// parca_agent_bpf_program_run_time_ns_total and parca_agent_bpf_map_entries
+// for objs.
+func NewIntrospectionCollector(objs *Module) prometheus.Collector {
+	return &introspectionCollector{
+		objs: objs,
+		runTimeDesc: prometheus.NewDesc(
+			"parca_agent_bpf_program_run_time_ns_total",
+			"Cumulative time the BPF program has spent executing, in nanoseconds.",
+			[]string{"program"}, nil,
+		),
+		mapEntries: prometheus.NewDesc(
+			"parca_agent_bpf_map_entries",
+			"Current number of entries in the BPF map.",
+			[]string{"map"}, nil,
+		),
+	}
+}
+
+func (c *introspectionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.runTimeDesc
+	ch <- c.mapEntries
+}
+
+func (c *introspectionCollector) Collect(ch chan<- prometheus.Metric) {
+	insp, err := c.objs.Introspect()
+	if err != nil {
+		return
+	}
+
+	for _, p := range insp.Programs {
+		ch <- prometheus.MustNewConstMetric(c.runTimeDesc, prometheus.CounterValue, float64(p.RunTimeNs), p.Name)
+	}
+	for _, m := range insp.Maps {
+		ch <- prometheus.MustNewConstMetric(c.mapEntries, prometheus.GaugeValue, float64(m.Entries), m.Name)
+	}
+}
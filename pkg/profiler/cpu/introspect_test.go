@@ -0,0 +1,59 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntrospectReportsLoadedMapsAndPrograms(t *testing.T) {
+	objs, err := SetUpBpfProgram(t)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, objs.Close()) })
+
+	insp, err := objs.Introspect()
+	require.NoError(t, err)
+	require.NotEmpty(t, insp.Maps)
+	require.NotEmpty(t, insp.Programs)
+
+	var sawStackCounts bool
+	for _, m := range insp.Maps {
+		if m.Name == "StackCounts" {
+			sawStackCounts = true
+		}
+	}
+	require.True(t, sawStackCounts, "expected StackCounts map in introspection output")
+}
+
+func TestDebugHandlerServesJSON(t *testing.T) {
+	objs, err := SetUpBpfProgram(t)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, objs.Close()) })
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/bpf", nil)
+	rec := httptest.NewRecorder()
+	NewDebugHandler(objs).ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var insp Introspection
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &insp))
+	require.NotEmpty(t, insp.Maps)
+}
@@ -0,0 +1,219 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cpu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/cilium/ebpf"
+)
+
+// ProcessStackCounts manages the per-process inner maps installed into the
+// stack_counts BPF_MAP_TYPE_HASH_OF_MAPS outer map. Keying stack counts by
+// process this way means draining or tearing down one process never has to
+// scan samples belonging to every other process on the host.
+type ProcessStackCounts struct {
+	outer     *ebpf.Map
+	innerSpec *ebpf.MapSpec
+	batchOps  bool
+}
+
+// newProcessStackCounts wraps outer, the loaded stack_counts map-of-maps,
+// using innerSpec (the inner map template) to size per-process maps it
+// creates on demand. batchOps reports whether the kernel supports
+// BPF_MAP_LOOKUP_AND_DELETE_BATCH; Drain falls back to single-key iteration
+// when it doesn't.
+func newProcessStackCounts(outer *ebpf.Map, innerSpec *ebpf.MapSpec, batchOps bool) *ProcessStackCounts {
+	return &ProcessStackCounts{outer: outer, innerSpec: innerSpec, batchOps: batchOps}
+}
+
+// EnsureProcess creates a stack-counts map for pid sized to
+// expectedCardinality (falling back to the template's default size when 0)
+// and installs it into the outer map, so the BPF program can start writing
+// samples for pid. Calling it again for a pid that already has a map is a
+// no-op that returns the existing map.
+func (p *ProcessStackCounts) EnsureProcess(pid uint32, expectedCardinality uint32) (*ebpf.Map, error) {
+	if existing, err := p.lookupInner(pid); err == nil {
+		return existing, nil
+	} else if !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return nil, err
+	}
+
+	spec := p.innerSpec.Copy()
+	spec.Name = fmt.Sprintf("stack_counts_%d", pid)
+	if expectedCardinality > 0 {
+		spec.MaxEntries = expectedCardinality
+	}
+
+	inner, err := ebpf.NewMap(spec)
+	if err != nil {
+		return nil, fmt.Errorf("create per-process stack-counts map for pid %d: %w", pid, err)
+	}
+
+	if err := p.outer.Put(pid, inner); err != nil {
+		inner.Close()
+		return nil, fmt.Errorf("register per-process stack-counts map for pid %d: %w", pid, err)
+	}
+
+	return inner, nil
+}
+
+// DeleteProcess removes pid's entry from the outer map. The kernel drops
+// the inner map's last reference once the BPF program stops using it, so
+// this single delete is all process teardown needs - no scan of a shared
+// global map required.
+func (p *ProcessStackCounts) DeleteProcess(pid uint32) error {
+	if err := p.outer.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("delete per-process stack-counts map for pid %d: %w", pid, err)
+	}
+	return nil
+}
+
+// lookupInner resolves pid's inner map ID in the outer map and opens a
+// handle to it. Callers must Close the returned map.
+func (p *ProcessStackCounts) lookupInner(pid uint32) (*ebpf.Map, error) {
+	var id ebpf.MapID
+	if err := p.outer.Lookup(pid, &id); err != nil {
+		return nil, err
+	}
+
+	inner, err := ebpf.NewMapFromID(id)
+	if err != nil {
+		// The process may have exited and had its inner map cleaned up
+		// between the outer lookup and here; treat that race the same as
+		// "no map for this pid" rather than as a hard failure.
+		if errors.Is(err, ebpf.ErrKeyNotExist) || errors.Is(err, os.ErrNotExist) {
+			return nil, ebpf.ErrKeyNotExist
+		}
+		return nil, fmt.Errorf("open inner map for pid %d: %w", pid, err)
+	}
+
+	return inner, nil
+}
+
+// Drain batch-drains pid's inner stack-counts map, returning the samples
+// accumulated since the last period. If pid has no inner map - because it
+// was never seen, or it exited mid-drain and the kernel already dropped its
+// map - Drain returns (nil, nil) rather than an error, since that is an
+// expected race rather than a failure.
+func (p *ProcessStackCounts) Drain(pid uint32) (map[stackCountKey]uint64, error) {
+	inner, err := p.lookupInner(pid)
+	if err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer inner.Close()
+
+	if p.batchOps {
+		return p.drainBatch(inner, pid)
+	}
+	return p.drainIterate(inner, pid)
+}
+
+// drainBatch drains inner using BPF_MAP_LOOKUP_AND_DELETE_BATCH, the fast
+// path on kernels that support it.
+func (p *ProcessStackCounts) drainBatch(inner *ebpf.Map, pid uint32) (map[stackCountKey]uint64, error) {
+	counts := make(map[stackCountKey]uint64)
+	keys := make([]stackCountKey, inner.MaxEntries())
+	values := make([]uint64, inner.MaxEntries())
+	cursor := new(ebpf.MapBatchCursor)
+
+	for {
+		n, err := inner.BatchLookupAndDelete(cursor, keys, values, nil)
+		for i := 0; i < n; i++ {
+			counts[keys[i]] += values[i]
+		}
+		if err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				break
+			}
+			return counts, fmt.Errorf("drain inner map for pid %d: %w", pid, err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	return counts, nil
+}
+
+// drainIterate drains inner one key at a time, for kernels that lack batch
+// map operations. It collects keys via a regular iterator first, since
+// deleting while iterating a hash map is not guaranteed to visit every
+// entry, then deletes each key individually.
+func (p *ProcessStackCounts) drainIterate(inner *ebpf.Map, pid uint32) (map[stackCountKey]uint64, error) {
+	counts := make(map[stackCountKey]uint64)
+
+	var key stackCountKey
+	var value uint64
+	it := inner.Iterate()
+	for it.Next(&key, &value) {
+		counts[key] += value
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("iterate inner map for pid %d: %w", pid, err)
+	}
+
+	for key := range counts {
+		if err := inner.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return counts, fmt.Errorf("delete drained key from inner map for pid %d: %w", pid, err)
+		}
+	}
+
+	return counts, nil
+}
+
+// DrainActive drains only the inner maps belonging to pids - the processes
+// that actually produced samples in the last period - instead of iterating
+// the outer map and touching every process on the host, most of which are
+// idle. A pid with no samples (or that exited mid-drain) is simply absent
+// from the result.
+func (p *ProcessStackCounts) DrainActive(pids []uint32) (map[uint32]map[stackCountKey]uint64, error) {
+	out := make(map[uint32]map[stackCountKey]uint64, len(pids))
+	for _, pid := range pids {
+		counts, err := p.Drain(pid)
+		if err != nil {
+			return nil, err
+		}
+		if len(counts) > 0 {
+			out[pid] = counts
+		}
+	}
+	return out, nil
+}
+
+// Processes iterates the outer map and returns every pid that currently has
+// a stack-counts map installed. It is the map-of-maps equivalent of
+// bpf_object__next_map, used by introspection and by callers that need the
+// full set of tracked processes rather than just the active ones.
+func (p *ProcessStackCounts) Processes() ([]uint32, error) {
+	var pids []uint32
+	var pid uint32
+	var id ebpf.MapID
+
+	it := p.outer.Iterate()
+	for it.Next(&pid, &id) {
+		pids = append(pids, pid)
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("iterate stack_counts outer map: %w", err)
+	}
+
+	return pids, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package verifiertest loads a compiled BPF collection against a matrix of
+// kernel versions and records how expensive the verifier found each program,
+// so a change to an unwinder that blows past the instruction limit on an
+// older kernel shows up as a golden-file diff in CI instead of a surprise
+// verifier rejection in the field.
+package verifiertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/cilium/ebpf"
+)
+
+// DefaultKernelVersions are the kernels CI checks every unwinder program
+// against, spanning the oldest kernel the agent claims to support through
+// the newest stable release and bpf-next.
+var DefaultKernelVersions = []string{"5.4", "5.10", "6.1", "bpf-next"}
+
+// Result captures what the verifier reported for a single program on a
+// single kernel version.
+type Result struct {
+	Kernel        string `json:"kernel"`
+	Program       string `json:"program"`
+	VerifierLog   string `json:"verifier_log,omitempty"`
+	InsnProcessed int    `json:"insn_processed"`
+	StackDepth    int    `json:"stack_depth"`
+	Complexity    int    `json:"complexity"`
+}
+
+// VerifierStats is satisfied by *ebpf.Program: VerifierLog and the
+// complexity fields it exposes after a LogLevelStats load.
+type VerifierStats interface {
+	VerifierLog() string
+}
+
+// KernelLoader loads spec's programs as if running on the named kernel
+// version, returning per-program verifier stats. Production code wires this
+// to the capability registry and/or a `-ci-kernel-version` matched kernel
+// image; tests can stub it to exercise the harness without real kernels.
+type KernelLoader func(kernelVersion string, spec *ebpf.CollectionSpec) (map[string]Result, error)
+
+// Harness runs spec's programs through KernelLoader for every kernel version
+// and collects the results.
+type Harness struct {
+	Spec           *ebpf.CollectionSpec
+	KernelLoader   KernelLoader
+	KernelVersions []string
+}
+
+// New creates a Harness for spec using the given loader. If versions is
+// empty, DefaultKernelVersions is used.
+func New(spec *ebpf.CollectionSpec, loader KernelLoader, versions []string) *Harness {
+	if len(versions) == 0 {
+		versions = DefaultKernelVersions
+	}
+	return &Harness{Spec: spec, KernelLoader: loader, KernelVersions: versions}
+}
+
+// Run loads every program in the collection spec against every configured
+// kernel version and returns one Result per (kernel, program) pair, sorted
+// for deterministic golden-file diffs.
+func (h *Harness) Run() ([]Result, error) {
+	var results []Result
+	for _, kv := range h.KernelVersions {
+		perProgram, err := h.KernelLoader(kv, h.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("load against kernel %s: %w", kv, err)
+		}
+		for name, res := range perProgram {
+			res.Kernel = kv
+			res.Program = name
+			results = append(results, res)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Kernel != results[j].Kernel {
+			return results[i].Kernel < results[j].Kernel
+		}
+		return results[i].Program < results[j].Program
+	})
+
+	return results, nil
+}
+
+// WriteGolden writes results to path as indented JSON.
+func WriteGolden(path string, results []Result) error {
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal golden results: %w", err)
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// CompareGolden reads the golden file at path and reports every (kernel,
+// program) pair whose recorded stats regressed: insn_processed, stack_depth
+// or complexity went up relative to the golden file.
+func CompareGolden(path string, got []Result) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read golden file: %w", err)
+	}
+
+	var want []Result
+	if err := json.Unmarshal(b, &want); err != nil {
+		return nil, fmt.Errorf("unmarshal golden file: %w", err)
+	}
+
+	wantByKey := make(map[string]Result, len(want))
+	for _, r := range want {
+		wantByKey[r.Kernel+"/"+r.Program] = r
+	}
+
+	var regressions []string
+	for _, r := range got {
+		base, ok := wantByKey[r.Kernel+"/"+r.Program]
+		if !ok {
+			continue
+		}
+		if r.InsnProcessed > base.InsnProcessed || r.StackDepth > base.StackDepth || r.Complexity > base.Complexity {
+			regressions = append(regressions, fmt.Sprintf(
+				"%s/%s: insn_processed %d->%d, stack_depth %d->%d, complexity %d->%d",
+				r.Kernel, r.Program,
+				base.InsnProcessed, r.InsnProcessed,
+				base.StackDepth, r.StackDepth,
+				base.Complexity, r.Complexity,
+			))
+		}
+	}
+
+	return regressions, nil
+}
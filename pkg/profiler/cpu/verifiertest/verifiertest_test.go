@@ -0,0 +1,61 @@
+// Copyright 2022-2023 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package verifiertest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeLoader(stats map[string]Result) KernelLoader {
+	return func(kernelVersion string, spec *ebpf.CollectionSpec) (map[string]Result, error) {
+		return stats, nil
+	}
+}
+
+func TestHarnessRunIsSortedAndTagged(t *testing.T) {
+	h := New(nil, fakeLoader(map[string]Result{
+		"unwind": {InsnProcessed: 100, StackDepth: 64, Complexity: 10},
+	}), []string{"6.1", "5.4"})
+
+	results, err := h.Run()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "5.4", results[0].Kernel)
+	require.Equal(t, "6.1", results[1].Kernel)
+	require.Equal(t, "unwind", results[0].Program)
+}
+
+func TestCompareGoldenDetectsRegression(t *testing.T) {
+	golden := filepath.Join(t.TempDir(), "golden.json")
+	require.NoError(t, WriteGolden(golden, []Result{
+		{Kernel: "5.4", Program: "unwind", InsnProcessed: 1000, StackDepth: 128, Complexity: 500},
+	}))
+
+	regressions, err := CompareGolden(golden, []Result{
+		{Kernel: "5.4", Program: "unwind", InsnProcessed: 2000, StackDepth: 128, Complexity: 500},
+	})
+	require.NoError(t, err)
+	require.Len(t, regressions, 1)
+
+	regressions, err = CompareGolden(golden, []Result{
+		{Kernel: "5.4", Program: "unwind", InsnProcessed: 900, StackDepth: 128, Complexity: 500},
+	})
+	require.NoError(t, err)
+	require.Empty(t, regressions)
+}